@@ -0,0 +1,36 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package cache
+
+import (
+	"context"
+	"time"
+)
+
+// Cache is a high level interface for storing chunk/index bytes for a bounded
+// amount of time or space. Most callers only need Store/Fetch and let TTL or
+// size-based eviction clear stale entries; Delete/DeleteByPrefix exist for the
+// few cases that can't wait for that, e.g. invalidating a cache after a block
+// is deleted from the bucket, or flushing everything belonging to one tenant.
+type Cache interface {
+	// Store stores data identified by keys, expiring after ttl.
+	Store(data map[string][]byte, ttl time.Duration)
+	// Fetch fetches multiple keys and returns a map containing cache hits.
+	Fetch(ctx context.Context, keys []string) map[string][]byte
+	// Delete removes key from the cache. It is a no-op if key isn't cached.
+	Delete(ctx context.Context, key string) error
+	// DeleteByPrefix removes every key with the given prefix and returns how many
+	// entries were removed. Implementations backed by more than one tier are not
+	// required to guarantee this across every tier: TieredCache, for instance,
+	// only removes matching keys from L1 and reports that count, leaving any L2
+	// copies to size-based eviction rather than real invalidation. Callers that
+	// need deletion to be guaranteed everywhere should check the concrete Cache
+	// implementation's docs before relying on DeleteByPrefix alone.
+	DeleteByPrefix(ctx context.Context, prefix string) (int, error)
+}
+
+var (
+	_ Cache = (*InMemoryCache)(nil)
+	_ Cache = (*TieredCache)(nil)
+)
@@ -0,0 +1,92 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package cache
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+)
+
+// TestInMemoryCache_Delete verifies that Delete removes the key and that the
+// shard's size counters are decremented accordingly.
+func TestInMemoryCache_Delete(t *testing.T) {
+	c, err := NewInMemoryCacheWithConfig("test", log.NewNopLogger(), nil, InMemoryCacheConfig{
+		MaxSize:     1024,
+		MaxItemSize: 1024,
+		Shards:      1,
+	})
+	if err != nil {
+		t.Fatalf("NewInMemoryCacheWithConfig: %v", err)
+	}
+	defer c.Close()
+
+	c.Store(map[string][]byte{"foo": []byte("bar")}, time.Hour)
+	if n, cur, _ := c.aggregateStats(); n != 1 || cur == 0 {
+		t.Fatalf("setup: expected 1 item with nonzero size, got n=%d cur=%d", n, cur)
+	}
+
+	if err := c.Delete(context.Background(), "foo"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+
+	res := c.Fetch(context.Background(), []string{"foo"})
+	if _, ok := res["foo"]; ok {
+		t.Fatalf("expected key to be gone after Delete")
+	}
+	if n, cur, total := c.aggregateStats(); n != 0 || cur != 0 || total != 0 {
+		t.Fatalf("expected size counters to be zeroed after Delete, got n=%d cur=%d total=%d", n, cur, total)
+	}
+}
+
+// TestInMemoryCache_DeleteByPrefix verifies that only keys matching the given
+// prefix are removed, wherever they land across shards, and that the
+// returned count reflects exactly those removals.
+func TestInMemoryCache_DeleteByPrefix(t *testing.T) {
+	c, err := NewInMemoryCacheWithConfig("test", log.NewNopLogger(), nil, InMemoryCacheConfig{
+		MaxSize:     1 << 20,
+		MaxItemSize: 1 << 20,
+		Shards:      16,
+	})
+	if err != nil {
+		t.Fatalf("NewInMemoryCacheWithConfig: %v", err)
+	}
+	defer c.Close()
+
+	data := map[string][]byte{}
+	for i := 0; i < 20; i++ {
+		data[string(rune('a'+i))+"-match"] = []byte("v")
+	}
+	data["other-key"] = []byte("v")
+	c.Store(data, time.Hour)
+
+	n, err := c.DeleteByPrefix(context.Background(), "")
+	if err != nil {
+		t.Fatalf("DeleteByPrefix: %v", err)
+	}
+	// Every key has an empty-string prefix, so this should have removed
+	// everything; reset and do a real prefix-scoped test below.
+	if n != len(data) {
+		t.Fatalf("DeleteByPrefix(\"\") removed %d, want %d", n, len(data))
+	}
+
+	c.Store(data, time.Hour)
+	n, err = c.DeleteByPrefix(context.Background(), "a-")
+	if err != nil {
+		t.Fatalf("DeleteByPrefix: %v", err)
+	}
+	if n != 1 {
+		t.Fatalf("DeleteByPrefix(\"a-\") removed %d, want 1", n)
+	}
+
+	res := c.Fetch(context.Background(), []string{"a-match", "other-key"})
+	if _, ok := res["a-match"]; ok {
+		t.Fatalf("expected \"a-match\" to be gone")
+	}
+	if _, ok := res["other-key"]; !ok {
+		t.Fatalf("expected \"other-key\" to survive the prefix delete")
+	}
+}
@@ -0,0 +1,235 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+
+	lru "github.com/hashicorp/golang-lru/v2/simplelru"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+
+	"github.com/thanos-io/thanos/pkg/model"
+)
+
+// DiskCacheConfig configures the disk-backed L2 tier used by TieredCache. Dir,
+// MaxSize, and MaxItemSize are all required: NewTieredCacheWithConfig rejects a
+// zero MaxSize/MaxItemSize rather than leaving L2 writes silently rejected
+// forever by diskCache.Set's size check.
+type DiskCacheConfig struct {
+	// Dir is the directory entries are written to. It is created if it does not exist.
+	Dir string `yaml:"dir"`
+	// MaxSize is the overall maximum number of bytes the directory may hold.
+	MaxSize model.Bytes `yaml:"max_size"`
+	// MaxItemSize is the maximum size of a single entry.
+	MaxItemSize model.Bytes `yaml:"max_item_size"`
+}
+
+// diskCache is a bounded, size-limited directory of sha256-named files, modeled on
+// bazel-remote's disk cache: entries are ranked for eviction by access time, so a
+// process restart can rebuild the recency order straight from the filesystem.
+type diskCache struct {
+	logger           log.Logger
+	dir              string
+	maxSizeBytes     uint64
+	maxItemSizeBytes uint64
+
+	mtx     sync.Mutex
+	curSize uint64
+	// lru tracks on-disk entries ordered by recency; the value is the file size in
+	// bytes. A Get() call moves its key to the front (the in-memory equivalent of
+	// bumping the file's atime).
+	lru *lru.LRU[string, uint64]
+}
+
+type direntStat struct {
+	key     string
+	size    uint64
+	atimeNs int64
+}
+
+func newDiskCache(logger log.Logger, config DiskCacheConfig) (*diskCache, error) {
+	if err := os.MkdirAll(config.Dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	d := &diskCache{
+		logger:           logger,
+		dir:              config.Dir,
+		maxSizeBytes:     uint64(config.MaxSize),
+		maxItemSizeBytes: uint64(config.MaxItemSize),
+	}
+
+	entries, err := scanDiskCacheDir(config.Dir)
+	if err != nil {
+		return nil, err
+	}
+	// Oldest atime first, so seeding the LRU in this order leaves the most recently
+	// used entries at the front, matching a cache that had been running all along.
+	sortDirentsByAtime(entries)
+
+	l, err := lru.NewLRU[string, uint64](maxInt, d.onEvict)
+	if err != nil {
+		return nil, err
+	}
+	d.lru = l
+	for _, e := range entries {
+		d.lru.Add(e.key, e.size)
+		d.curSize += e.size
+	}
+	for d.curSize > d.maxSizeBytes {
+		if _, _, ok := d.lru.RemoveOldest(); !ok {
+			break
+		}
+	}
+
+	return d, nil
+}
+
+func (d *diskCache) onEvict(hexKey string, size uint64) {
+	d.curSize -= size
+	if err := os.Remove(d.pathForHex(hexKey)); err != nil && !os.IsNotExist(err) {
+		level.Warn(d.logger).Log("msg", "failed to remove evicted disk cache entry", "err", err)
+	}
+}
+
+// hexKey returns the filename an entry for key is stored under: its sha256 hex
+// digest, so arbitrary cache keys map to safe, fixed-length filenames.
+func hexKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func (d *diskCache) pathForHex(hexSum string) string {
+	return filepath.Join(d.dir, hexSum[:2], hexSum)
+}
+
+func (d *diskCache) Get(key string) ([]byte, bool) {
+	hk := hexKey(key)
+
+	d.mtx.Lock()
+	_, ok := d.lru.Get(hk)
+	d.mtx.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	data, err := os.ReadFile(d.pathForHex(hk))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			level.Warn(d.logger).Log("msg", "failed to read disk cache entry", "err", err)
+		}
+		return nil, false
+	}
+	return data, true
+}
+
+// Set writes val to disk under key, evicting older entries if needed to stay
+// within the size budget. Returns false if val was too big or couldn't be written.
+func (d *diskCache) Set(key string, val []byte) bool {
+	size := uint64(len(val))
+	if size > d.maxItemSizeBytes {
+		return false
+	}
+
+	hk := hexKey(key)
+	path := d.pathForHex(hk)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		level.Warn(d.logger).Log("msg", "failed to create disk cache shard dir", "path", path, "err", err)
+		return false
+	}
+	// Write to a uniquely-named temp file in the same directory and rename into
+	// place, so a concurrent Get (e.g. racing with onL1Evict re-writing the same
+	// key from two evictions in a row) can never observe a partially-written or
+	// truncated file at path.
+	tmpFile, err := os.CreateTemp(filepath.Dir(path), hk+".tmp-*")
+	if err != nil {
+		level.Warn(d.logger).Log("msg", "failed to create disk cache temp file", "err", err)
+		return false
+	}
+	tmp := tmpFile.Name()
+	_, writeErr := tmpFile.Write(val)
+	closeErr := tmpFile.Close()
+	if writeErr != nil || closeErr != nil {
+		level.Warn(d.logger).Log("msg", "failed to write disk cache entry", "err", fmt.Errorf("write: %v, close: %v", writeErr, closeErr))
+		os.Remove(tmp)
+		return false
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		level.Warn(d.logger).Log("msg", "failed to finalize disk cache entry", "err", err)
+		os.Remove(tmp)
+		return false
+	}
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	// Get bumps hk to the front of the LRU, so the eviction loop below can never
+	// pick it as the oldest entry to remove.
+	if oldSize, ok := d.lru.Get(hk); ok {
+		if size >= oldSize {
+			d.curSize += size - oldSize
+		} else {
+			d.curSize -= oldSize - size
+		}
+		for d.curSize > d.maxSizeBytes {
+			if _, _, ok := d.lru.RemoveOldest(); !ok {
+				break
+			}
+		}
+		d.lru.Add(hk, size)
+		return true
+	}
+
+	for d.curSize+size > d.maxSizeBytes {
+		if _, _, ok := d.lru.RemoveOldest(); !ok {
+			break
+		}
+	}
+	d.lru.Add(hk, size)
+	d.curSize += size
+	return true
+}
+
+// Delete removes key from disk, if present.
+func (d *diskCache) Delete(key string) bool {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	return d.lru.Remove(hexKey(key))
+}
+
+func scanDiskCacheDir(dir string) ([]direntStat, error) {
+	var entries []direntStat
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+
+		key := filepath.Base(path)
+		atimeNs := int64(0)
+		if sys, ok := info.Sys().(*syscall.Stat_t); ok {
+			atimeNs = sys.Atim.Sec*1e9 + sys.Atim.Nsec
+		}
+		entries = append(entries, direntStat{key: key, size: uint64(info.Size()), atimeNs: atimeNs})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func sortDirentsByAtime(entries []direntStat) {
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].atimeNs < entries[j].atimeNs
+	})
+}
@@ -0,0 +1,137 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package cache
+
+import (
+	"testing"
+
+	"github.com/go-kit/log"
+)
+
+// TestDiskCache_SurvivesRestart verifies that a diskCache opened against a
+// directory populated by an earlier instance (simulating a process restart)
+// can still read back everything that was written, with curSize reflecting
+// what's actually on disk.
+func TestDiskCache_SurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	config := DiskCacheConfig{Dir: dir, MaxSize: 1 << 20, MaxItemSize: 1 << 20}
+
+	d1, err := newDiskCache(log.NewNopLogger(), config)
+	if err != nil {
+		t.Fatalf("newDiskCache: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		key := string(rune('a' + i))
+		if !d1.Set(key, []byte(key+key+key)) {
+			t.Fatalf("Set(%q) failed", key)
+		}
+	}
+
+	// A fresh diskCache pointed at the same directory stands in for the
+	// process restarting.
+	d2, err := newDiskCache(log.NewNopLogger(), config)
+	if err != nil {
+		t.Fatalf("newDiskCache (restart): %v", err)
+	}
+
+	for i := 0; i < 10; i++ {
+		key := string(rune('a' + i))
+		got, ok := d2.Get(key)
+		if !ok {
+			t.Fatalf("Get(%q) after restart: not found", key)
+		}
+		if string(got) != key+key+key {
+			t.Fatalf("Get(%q) after restart: got %q", key, got)
+		}
+	}
+	if d2.curSize != d1.curSize {
+		t.Fatalf("curSize after restart = %d, want %d", d2.curSize, d1.curSize)
+	}
+}
+
+// TestDiskCache_RestartEvictsDownToBudget verifies that if the on-disk
+// contents exceed a smaller MaxSize configured after a restart, the oldest
+// entries (by atime) are evicted to bring curSize back under budget.
+func TestDiskCache_RestartEvictsDownToBudget(t *testing.T) {
+	dir := t.TempDir()
+
+	d1, err := newDiskCache(log.NewNopLogger(), DiskCacheConfig{Dir: dir, MaxSize: 1 << 20, MaxItemSize: 1 << 20})
+	if err != nil {
+		t.Fatalf("newDiskCache: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		key := string(rune('a' + i))
+		if !d1.Set(key, []byte(key+key+key)) {
+			t.Fatalf("Set(%q) failed", key)
+		}
+	}
+
+	d2, err := newDiskCache(log.NewNopLogger(), DiskCacheConfig{Dir: dir, MaxSize: 15, MaxItemSize: 1 << 20})
+	if err != nil {
+		t.Fatalf("newDiskCache (restart with smaller budget): %v", err)
+	}
+	if d2.curSize > 15 {
+		t.Fatalf("curSize after restart = %d, want <= 15", d2.curSize)
+	}
+	if d2.lru.Len() >= 10 {
+		t.Fatalf("expected some entries to be evicted on restart, still have %d", d2.lru.Len())
+	}
+}
+
+// TestDiskCache_SetUpdatesSizeOnOverwrite verifies that re-Set'ing an existing
+// key with a differently-sized value keeps curSize in sync with what's
+// actually on disk, rather than leaving it pinned to the first write's size.
+func TestDiskCache_SetUpdatesSizeOnOverwrite(t *testing.T) {
+	dir := t.TempDir()
+	d, err := newDiskCache(log.NewNopLogger(), DiskCacheConfig{Dir: dir, MaxSize: 1 << 20, MaxItemSize: 1 << 20})
+	if err != nil {
+		t.Fatalf("newDiskCache: %v", err)
+	}
+
+	if !d.Set("foo", []byte("a")) {
+		t.Fatalf("Set(len 1) failed")
+	}
+	if d.curSize != 1 {
+		t.Fatalf("curSize after first Set = %d, want 1", d.curSize)
+	}
+
+	if !d.Set("foo", []byte("abcdefghij")) {
+		t.Fatalf("Set(len 10) failed")
+	}
+	if d.curSize != 10 {
+		t.Fatalf("curSize after overwriting with a bigger value = %d, want 10", d.curSize)
+	}
+
+	got, ok := d.Get("foo")
+	if !ok || string(got) != "abcdefghij" {
+		t.Fatalf("Get(foo) = %q, %v, want %q, true", got, ok, "abcdefghij")
+	}
+
+	if !d.Set("foo", []byte("x")) {
+		t.Fatalf("Set(len 1) failed")
+	}
+	if d.curSize != 1 {
+		t.Fatalf("curSize after overwriting with a smaller value = %d, want 1", d.curSize)
+	}
+}
+
+// TestDiskCache_Delete verifies that Delete removes an entry and that it is
+// no longer retrievable afterwards.
+func TestDiskCache_Delete(t *testing.T) {
+	dir := t.TempDir()
+	d, err := newDiskCache(log.NewNopLogger(), DiskCacheConfig{Dir: dir, MaxSize: 1 << 20, MaxItemSize: 1 << 20})
+	if err != nil {
+		t.Fatalf("newDiskCache: %v", err)
+	}
+
+	if !d.Set("foo", []byte("bar")) {
+		t.Fatalf("Set failed")
+	}
+	if !d.Delete("foo") {
+		t.Fatalf("Delete reported no entry removed")
+	}
+	if _, ok := d.Get("foo"); ok {
+		t.Fatalf("expected Get to miss after Delete")
+	}
+}
@@ -0,0 +1,56 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package cache
+
+import (
+	"time"
+
+	"github.com/hashicorp/golang-lru/v2/expirable"
+)
+
+// expirableLRU is a thin wrapper around golang-lru/v2/expirable.LRU, used by
+// InMemoryCache when every entry shares the same TTL. Unlike the default lru.LRU
+// store, it expires entries on its own, so callers don't need to carry a
+// cacheDataWithTTLWrapper or check expiryTime on every Get.
+type expirableLRU struct {
+	lru *expirable.LRU[string, []byte]
+}
+
+// newExpirableLRU creates an expirableLRU with no size limit on number of items;
+// InMemoryCache enforces the byte-size budget itself via RemoveOldest.
+func newExpirableLRU(ttl time.Duration, onEvict func(key string, val cacheDataWithTTLWrapper)) *expirableLRU {
+	return &expirableLRU{
+		lru: expirable.NewLRU[string, []byte](0, func(key string, val []byte) {
+			onEvict(key, cacheDataWithTTLWrapper{data: val})
+		}, ttl),
+	}
+}
+
+func (e *expirableLRU) Get(key string) ([]byte, bool) {
+	return e.lru.Get(key)
+}
+
+func (e *expirableLRU) Contains(key string) bool {
+	return e.lru.Contains(key)
+}
+
+func (e *expirableLRU) Add(key string, val []byte) {
+	e.lru.Add(key, val)
+}
+
+func (e *expirableLRU) RemoveOldest() (string, []byte, bool) {
+	return e.lru.RemoveOldest()
+}
+
+func (e *expirableLRU) Remove(key string) bool {
+	return e.lru.Remove(key)
+}
+
+func (e *expirableLRU) Keys() []string {
+	return e.lru.Keys()
+}
+
+func (e *expirableLRU) Purge() {
+	e.lru.Purge()
+}
@@ -8,9 +8,9 @@ import (
 	"sync"
 	"time"
 
+	"github.com/cespare/xxhash/v2"
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
-	lru "github.com/hashicorp/golang-lru/v2/simplelru"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
@@ -23,6 +23,7 @@ var (
 	DefaultInMemoryCacheConfig = InMemoryCacheConfig{
 		MaxSize:     250 * 1024 * 1024,
 		MaxItemSize: 125 * 1024 * 1024,
+		Shards:      16,
 	}
 )
 
@@ -36,28 +37,45 @@ type InMemoryCacheConfig struct {
 	MaxSize model.Bytes `yaml:"max_size"`
 	// MaxItemSize represents maximum size of single item.
 	MaxItemSize model.Bytes `yaml:"max_item_size"`
+	// CleanupInterval, if set, runs a background janitor that periodically walks the
+	// cache and evicts entries whose TTL has passed, instead of relying solely on the
+	// lazy eviction that happens on access. Zero disables the janitor.
+	CleanupInterval model.Duration `yaml:"cleanup_interval"`
+	// TTL, if set, declares that every Set() call against this cache instance uses the
+	// same TTL. This lets the cache use golang-lru/v2/expirable as its backing store,
+	// which expires entries on its own, instead of the per-item TTL wrapper and its
+	// lazy-expiry code path. The ttl argument passed to Store() is ignored in this mode.
+	TTL model.Duration `yaml:"ttl"`
+	// Shards is the number of independent partitions the cache is split into, so that
+	// concurrent Get/Set calls on different keys don't serialize on a single mutex.
+	// Must be a power of two.
+	Shards int `yaml:"shards"`
+	// EvictionPolicy selects the strategy used to decide what to evict once the
+	// cache is over its size budget: "lru" (default) or "s3fifo". s3fifo trades a
+	// little LRU-workload performance for scan resistance, so a single large
+	// range scan can't wipe out a shard's long-resident, frequently hit entries.
+	// It does not apply when TTL is set, since that mode bypasses this store
+	// entirely in favor of golang-lru/v2/expirable.
+	EvictionPolicy string `yaml:"eviction_policy"`
+	// S3FIFO tunes the S3-FIFO policy's S/M ratio and ghost queue size. Ignored
+	// unless EvictionPolicy is "s3fifo"; the per-queue size gauges this cache
+	// exposes are the signal operators use to decide how to set these.
+	S3FIFO S3FIFOConfig `yaml:"eviction_policy_s3fifo"`
 }
 
 type InMemoryCache struct {
 	logger           log.Logger
+	name             string
 	maxSizeBytes     uint64
 	maxItemSizeBytes uint64
-	name             string
 
-	mtx         sync.Mutex
-	curSize     uint64
-	lru         *lru.LRU[string, cacheDataWithTTLWrapper]
-	evicted     prometheus.Counter
-	requests    prometheus.Counter
-	hits        prometheus.Counter
-	hitsExpired prometheus.Counter
-	// The input cache value would be copied to an inmemory array
-	// instead of simply using the one sent by the caller.
-	added            prometheus.Counter
-	current          prometheus.Gauge
-	currentSize      prometheus.Gauge
-	totalCurrentSize prometheus.Gauge
-	overflow         prometheus.Counter
+	shards    []*inMemoryShard
+	shardMask uint64
+
+	stopCleanup chan struct{}
+	cleanupWG   sync.WaitGroup
+
+	metrics *shardMetrics
 }
 
 type cacheDataWithTTLWrapper struct {
@@ -98,76 +116,106 @@ func NewInMemoryCacheWithConfig(name string, logger log.Logger, reg prometheus.R
 	if config.MaxItemSize > config.MaxSize {
 		return nil, errors.Errorf("max item size (%v) cannot be bigger than overall cache size (%v)", config.MaxItemSize, config.MaxSize)
 	}
+	if config.Shards <= 0 {
+		config.Shards = DefaultInMemoryCacheConfig.Shards
+	}
+	if config.Shards&(config.Shards-1) != 0 {
+		return nil, errors.Errorf("shards (%v) must be a power of two", config.Shards)
+	}
+	if config.EvictionPolicy == "" {
+		config.EvictionPolicy = defaultEvictionPolicy
+	}
+	if config.EvictionPolicy != evictionPolicyLRU && config.EvictionPolicy != evictionPolicyS3FIFO {
+		return nil, errors.Errorf("unknown eviction policy %q", config.EvictionPolicy)
+	}
 
 	c := &InMemoryCache{
 		logger:           logger,
 		maxSizeBytes:     uint64(config.MaxSize),
 		maxItemSizeBytes: uint64(config.MaxItemSize),
 		name:             name,
+		shardMask:        uint64(config.Shards - 1),
+		stopCleanup:      make(chan struct{}),
 	}
 
-	c.evicted = promauto.With(reg).NewCounter(prometheus.CounterOpts{
-		Name:        "thanos_cache_inmemory_items_evicted_total",
-		Help:        "Total number of items that were evicted from the inmemory cache.",
-		ConstLabels: prometheus.Labels{"name": name},
-	})
-
-	c.added = promauto.With(reg).NewCounter(prometheus.CounterOpts{
-		Name:        "thanos_cache_inmemory_items_added_total",
-		Help:        "Total number of items that were added to the inmemory cache.",
-		ConstLabels: prometheus.Labels{"name": name},
-	})
-
-	c.requests = promauto.With(reg).NewCounter(prometheus.CounterOpts{
-		Name:        "thanos_cache_inmemory_requests_total",
-		Help:        "Total number of requests to the inmemory cache.",
-		ConstLabels: prometheus.Labels{"name": name},
-	})
-
-	c.hitsExpired = promauto.With(reg).NewCounter(prometheus.CounterOpts{
-		Name:        "thanos_cache_inmemory_hits_on_expired_data_total",
-		Help:        "Total number of requests to the inmemory cache that were a hit but needed to be evicted due to TTL.",
-		ConstLabels: prometheus.Labels{"name": name},
-	})
-
-	c.overflow = promauto.With(reg).NewCounter(prometheus.CounterOpts{
-		Name:        "thanos_cache_inmemory_items_overflowed_total",
-		Help:        "Total number of items that could not be added to the inmemory cache due to being too big.",
-		ConstLabels: prometheus.Labels{"name": name},
-	})
-
-	c.hits = promauto.With(reg).NewCounter(prometheus.CounterOpts{
-		Name:        "thanos_cache_inmemory_hits_total",
-		Help:        "Total number of requests to the inmemory cache that were a hit.",
-		ConstLabels: prometheus.Labels{"name": name},
-	})
+	c.metrics = &shardMetrics{
+		evicted: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name:        "thanos_cache_inmemory_items_evicted_total",
+			Help:        "Total number of items that were evicted from the inmemory cache.",
+			ConstLabels: prometheus.Labels{"name": name},
+		}),
+		added: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name:        "thanos_cache_inmemory_items_added_total",
+			Help:        "Total number of items that were added to the inmemory cache.",
+			ConstLabels: prometheus.Labels{"name": name},
+		}),
+		requests: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name:        "thanos_cache_inmemory_requests_total",
+			Help:        "Total number of requests to the inmemory cache.",
+			ConstLabels: prometheus.Labels{"name": name},
+		}),
+		hitsExpired: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name:        "thanos_cache_inmemory_hits_on_expired_data_total",
+			Help:        "Total number of requests to the inmemory cache that were a hit but needed to be evicted due to TTL.",
+			ConstLabels: prometheus.Labels{"name": name},
+		}),
+		ttlExpirations: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name:        "thanos_cache_inmemory_ttl_expirations_total",
+			Help:        "Total number of items removed from the inmemory cache by the background TTL janitor.",
+			ConstLabels: prometheus.Labels{"name": name},
+		}),
+		overflow: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name:        "thanos_cache_inmemory_items_overflowed_total",
+			Help:        "Total number of items that could not be added to the inmemory cache due to being too big.",
+			ConstLabels: prometheus.Labels{"name": name},
+		}),
+		hits: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name:        "thanos_cache_inmemory_hits_total",
+			Help:        "Total number of requests to the inmemory cache that were a hit.",
+			ConstLabels: prometheus.Labels{"name": name},
+		}),
+		deletions: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name:        "thanos_cache_inmemory_deletions_total",
+			Help:        "Total number of explicit deletions from the inmemory cache, by reason.",
+			ConstLabels: prometheus.Labels{"name": name},
+		}, []string{"reason"}),
+	}
 
-	c.current = promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+	promauto.With(reg).NewGaugeFunc(prometheus.GaugeOpts{
 		Name:        "thanos_cache_inmemory_items",
 		Help:        "Current number of items in the inmemory cache.",
 		ConstLabels: prometheus.Labels{"name": name},
+	}, func() float64 {
+		n, _, _ := c.aggregateStats()
+		return float64(n)
 	})
 
-	c.currentSize = promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+	promauto.With(reg).NewGaugeFunc(prometheus.GaugeOpts{
 		Name:        "thanos_cache_inmemory_items_size_bytes",
 		Help:        "Current byte size of items in the inmemory cache.",
 		ConstLabels: prometheus.Labels{"name": name},
+	}, func() float64 {
+		_, curSize, _ := c.aggregateStats()
+		return float64(curSize)
 	})
 
-	c.totalCurrentSize = promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+	promauto.With(reg).NewGaugeFunc(prometheus.GaugeOpts{
 		Name:        "thanos_cache_inmemory_total_size_bytes",
 		Help:        "Current byte size of items (both value and key) in the inmemory cache.",
 		ConstLabels: prometheus.Labels{"name": name},
+	}, func() float64 {
+		_, _, totalSize := c.aggregateStats()
+		return float64(totalSize)
 	})
 
-	_ = promauto.With(reg).NewGaugeFunc(prometheus.GaugeOpts{
+	promauto.With(reg).NewGaugeFunc(prometheus.GaugeOpts{
 		Name:        "thanos_cache_inmemory_max_size_bytes",
 		Help:        "Maximum number of bytes to be held in the inmemory cache.",
 		ConstLabels: prometheus.Labels{"name": name},
 	}, func() float64 {
 		return float64(c.maxSizeBytes)
 	})
-	_ = promauto.With(reg).NewGaugeFunc(prometheus.GaugeOpts{
+	promauto.With(reg).NewGaugeFunc(prometheus.GaugeOpts{
 		Name:        "thanos_cache_inmemory_max_item_size_bytes",
 		Help:        "Maximum number of bytes for single entry to be held in the inmemory cache.",
 		ConstLabels: prometheus.Labels{"name": name},
@@ -175,139 +223,196 @@ func NewInMemoryCacheWithConfig(name string, logger log.Logger, reg prometheus.R
 		return float64(c.maxItemSizeBytes)
 	})
 
-	// Initialize LRU cache with a high size limit since we will manage evictions ourselves
-	// based on stored size using `RemoveOldest` method.
-	l, err := lru.NewLRU[string, cacheDataWithTTLWrapper](maxInt, c.onEvict)
-	if err != nil {
-		return nil, err
+	promauto.With(reg).NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        "thanos_cache_inmemory_policy",
+		Help:        "Always 1. The eviction policy in use, in the \"policy\" label.",
+		ConstLabels: prometheus.Labels{"name": name, "policy": config.EvictionPolicy},
+	}, func() float64 {
+		return 1
+	})
+
+	if config.EvictionPolicy == evictionPolicyS3FIFO {
+		promauto.With(reg).NewGaugeFunc(prometheus.GaugeOpts{
+			Name:        "thanos_cache_inmemory_s3fifo_small_size_bytes",
+			Help:        "Current byte size of the S3-FIFO small (S) queue, summed across shards.",
+			ConstLabels: prometheus.Labels{"name": name},
+		}, func() float64 {
+			sSize, _ := c.aggregateS3FIFOSizes()
+			return float64(sSize)
+		})
+		promauto.With(reg).NewGaugeFunc(prometheus.GaugeOpts{
+			Name:        "thanos_cache_inmemory_s3fifo_main_size_bytes",
+			Help:        "Current byte size of the S3-FIFO main (M) queue, summed across shards.",
+			ConstLabels: prometheus.Labels{"name": name},
+		}, func() float64 {
+			_, mSize := c.aggregateS3FIFOSizes()
+			return float64(mSize)
+		})
+	}
+
+	// The total-size budget is divided evenly across shards, since a shard only
+	// ever needs to hold its own fraction of the overall working set. MaxItemSize
+	// is not divided: a single item is never split across shards, so dividing it
+	// would silently shrink the documented "maximum size of a single item" by the
+	// shard count.
+	//
+	// An evenly-divided share can end up smaller than MaxItemSize once Shards
+	// grows large enough (e.g. the package defaults: 250MB/16 < 125MB), which
+	// would make every shard reject items well within the documented,
+	// un-sharded MaxItemSize. A shard's budget is therefore never let drop
+	// below MaxItemSize, at the cost of the total size bound becoming only
+	// approximate (as NewInMemoryCacheWithConfig's doc comment already
+	// caveats) rather than exact in that case.
+	shardMaxSize := c.maxSizeBytes / uint64(config.Shards)
+	if shardMaxSize < c.maxItemSizeBytes {
+		shardMaxSize = c.maxItemSizeBytes
+	}
+
+	c.shards = make([]*inMemoryShard, config.Shards)
+	for i := range c.shards {
+		s, err := newInMemoryShard(logger, shardMaxSize, c.maxItemSizeBytes, time.Duration(config.TTL), config.EvictionPolicy, config.S3FIFO, c.metrics)
+		if err != nil {
+			return nil, err
+		}
+		c.shards[i] = s
+	}
+
+	if config.TTL == 0 && config.CleanupInterval > 0 {
+		c.cleanupWG.Add(1)
+		go c.runCleanup(time.Duration(config.CleanupInterval))
 	}
-	c.lru = l
 
 	level.Info(logger).Log(
 		"msg", "created in-memory inmemory cache",
 		"maxItemSizeBytes", c.maxItemSizeBytes,
 		"maxSizeBytes", c.maxSizeBytes,
+		"shards", config.Shards,
 		"maxItems", "maxInt",
 	)
 	return c, nil
 }
 
-func (c *InMemoryCache) onEvict(key string, val cacheDataWithTTLWrapper) {
-	keySize := uint64(len(key))
-	entrySize := uint64(len(val.data))
-
-	c.evicted.Inc()
-	c.current.Dec()
-	c.currentSize.Sub(float64(entrySize))
-	c.totalCurrentSize.Sub(float64(keySize + entrySize))
-
-	c.curSize -= entrySize
+// setEvictionListener registers fn to be called, synchronously from within the
+// owning shard's critical section, whenever an entry is evicted from the cache.
+// It must be called before the cache is exposed to any traffic. Callers that do
+// non-trivial work in fn (e.g. TieredCache writing to disk) should hand off to a
+// goroutine rather than blocking the shard.
+func (c *InMemoryCache) setEvictionListener(fn func(key string, val cacheDataWithTTLWrapper)) {
+	c.metrics.onItemEvicted = fn
 }
 
-func (c *InMemoryCache) get(key string) ([]byte, bool) {
-	c.requests.Inc()
-	c.mtx.Lock()
-	defer c.mtx.Unlock()
-
-	v, ok := c.lru.Get(key)
-	if !ok {
-		return nil, false
-	}
-	// If the present time is greater than the TTL for the object from cache, the object will be
-	// removed from the cache and a nil will be returned
-	if time.Now().After(v.expiryTime) {
-		c.hitsExpired.Inc()
-		c.lru.Remove(key)
-		return nil, false
-	}
-	c.hits.Inc()
-	return v.data, true
+// shardFor returns the shard that owns key.
+func (c *InMemoryCache) shardFor(key string) *inMemoryShard {
+	return c.shards[xxhash.Sum64String(key)&c.shardMask]
 }
 
-func (c *InMemoryCache) set(key string, val []byte, ttl time.Duration) {
-	var size = uint64(len(val))
-	keySize := uint64(len(key))
-
-	c.mtx.Lock()
-	defer c.mtx.Unlock()
-
-	if _, ok := c.lru.Get(key); ok {
-		return
+// aggregateStats sums item count and byte sizes across all shards. It is only
+// called from GaugeFunc collectors on scrape, so taking every shard's mutex in
+// turn is cheap relative to the per-request lock contention it replaces.
+func (c *InMemoryCache) aggregateStats() (itemCount int, curSize, totalSize uint64) {
+	for _, s := range c.shards {
+		n, cur, total := s.stats()
+		itemCount += n
+		curSize += cur
+		totalSize += total
 	}
-
-	if !c.ensureFits(size) {
-		c.overflow.Inc()
-		return
-	}
-
-	// The caller may be passing in a sub-slice of a huge array. Copy the data
-	// to ensure we don't waste huge amounts of space for something small.
-	v := make([]byte, len(val))
-	copy(v, val)
-	c.lru.Add(key, cacheDataWithTTLWrapper{data: v, expiryTime: time.Now().Add(ttl)})
-
-	c.added.Inc()
-	c.currentSize.Add(float64(size))
-	c.totalCurrentSize.Add(float64(keySize + size))
-	c.current.Inc()
-	c.curSize += size
+	return
 }
 
-// ensureFits tries to make sure that the passed slice will fit into the LRU cache.
-// Returns true if it will fit.
-func (c *InMemoryCache) ensureFits(size uint64) bool {
-	if size > c.maxItemSizeBytes {
-		level.Debug(c.logger).Log(
-			"msg", "item bigger than maxItemSizeBytes. Ignoring..",
-			"maxItemSizeBytes", c.maxItemSizeBytes,
-			"maxSizeBytes", c.maxSizeBytes,
-			"curSize", c.curSize,
-			"itemSize", size,
-		)
-		return false
+// aggregateS3FIFOSizes sums the S and M queue byte sizes across all shards. It is
+// a no-op, returning (0, 0), unless the cache is running the s3fifo policy.
+func (c *InMemoryCache) aggregateS3FIFOSizes() (sSize, mSize uint64) {
+	for _, s := range c.shards {
+		ss, ms, ok := s.s3fifoQueueSizes()
+		if !ok {
+			continue
+		}
+		sSize += ss
+		mSize += ms
 	}
+	return
+}
 
-	for c.curSize+size > c.maxSizeBytes {
-		if _, _, ok := c.lru.RemoveOldest(); !ok {
-			level.Error(c.logger).Log(
-				"msg", "LRU has nothing more to evict, but we still cannot allocate the item. Resetting cache.",
-				"maxItemSizeBytes", c.maxItemSizeBytes,
-				"maxSizeBytes", c.maxSizeBytes,
-				"curSize", c.curSize,
-				"itemSize", size,
-			)
-			c.reset()
+// runCleanup periodically sweeps every shard for entries whose TTL has passed, so
+// cold expired items stop consuming curSize and skewing eviction decisions until
+// they happen to be touched again.
+func (c *InMemoryCache) runCleanup(interval time.Duration) {
+	defer c.cleanupWG.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			for _, s := range c.shards {
+				s.sweepExpired()
+			}
+		case <-c.stopCleanup:
+			return
 		}
 	}
-	return true
 }
 
-func (c *InMemoryCache) reset() {
-	c.lru.Purge()
-	c.current.Set(0)
-	c.currentSize.Set(0)
-	c.totalCurrentSize.Set(0)
-	c.curSize = 0
+// Close stops the background TTL janitor, if one was started. It is safe to call
+// on a cache that never started one.
+func (c *InMemoryCache) Close() error {
+	select {
+	case <-c.stopCleanup:
+		// Already closed.
+	default:
+		close(c.stopCleanup)
+	}
+	c.cleanupWG.Wait()
+	return nil
 }
 
 func (c *InMemoryCache) Store(data map[string][]byte, ttl time.Duration) {
 	for key, val := range data {
-		c.set(key, val, ttl)
+		c.shardFor(key).set(key, val, ttl)
 	}
 }
 
 // Fetch fetches multiple keys and returns a map containing cache hits
 // In case of error, it logs and return an empty cache hits map.
 func (c *InMemoryCache) Fetch(ctx context.Context, keys []string) map[string][]byte {
-	results := make(map[string][]byte)
+	// Group keys by shard up front, then fetch each shard's keys through a single
+	// getMulti call, so a shard is locked once total rather than once per key.
+	byShard := make(map[*inMemoryShard][]string, len(c.shards))
 	for _, key := range keys {
-		if b, ok := c.get(key); ok {
-			results[key] = b
-		}
+		s := c.shardFor(key)
+		byShard[s] = append(byShard[s], key)
+	}
+
+	results := make(map[string][]byte, len(keys))
+	for s, shardKeys := range byShard {
+		s.getMulti(shardKeys, results)
 	}
 	return results
 }
 
+// Delete removes key from the cache. It is a no-op if key isn't cached.
+func (c *InMemoryCache) Delete(_ context.Context, key string) error {
+	if c.shardFor(key).delete(key) {
+		c.metrics.deletions.WithLabelValues("explicit").Inc()
+	}
+	return nil
+}
+
+// DeleteByPrefix removes every key with the given prefix and returns how many
+// entries were removed. Since prefixes can hash to any shard, every shard is
+// walked; each shard is only locked once regardless of how many of its keys match.
+func (c *InMemoryCache) DeleteByPrefix(_ context.Context, prefix string) (int, error) {
+	n := 0
+	for _, s := range c.shards {
+		n += s.deleteByPrefix(prefix)
+	}
+	if n > 0 {
+		c.metrics.deletions.WithLabelValues("prefix").Add(float64(n))
+	}
+	return n, nil
+}
+
 func (c *InMemoryCache) Name() string {
 	return c.name
 }
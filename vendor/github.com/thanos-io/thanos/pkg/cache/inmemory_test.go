@@ -0,0 +1,128 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package cache
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+)
+
+// TestInMemoryCache_Sharding verifies that keys are spread across more than
+// one shard and that shardFor is stable for a given key.
+func TestInMemoryCache_Sharding(t *testing.T) {
+	c, err := NewInMemoryCacheWithConfig("test", log.NewNopLogger(), nil, InMemoryCacheConfig{
+		MaxSize:     1 << 20,
+		MaxItemSize: 1 << 20,
+		Shards:      16,
+	})
+	if err != nil {
+		t.Fatalf("NewInMemoryCacheWithConfig: %v", err)
+	}
+	defer c.Close()
+
+	seen := make(map[*inMemoryShard]bool)
+	for i := 0; i < 256; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		seen[c.shardFor(key)] = true
+		if c.shardFor(key) != c.shardFor(key) {
+			t.Fatalf("shardFor(%q) is not stable across calls", key)
+		}
+	}
+	if len(seen) <= 1 {
+		t.Fatalf("expected keys to be spread across multiple shards, all landed on %d", len(seen))
+	}
+}
+
+// TestInMemoryCache_MaxItemSizeNotDividedByShards verifies that an item within
+// MaxItemSize fits regardless of how many shards the cache is split into: the
+// budget describes a single item, which is never split across shards, unlike
+// the total-size budget. It uses the same MaxSize/MaxItemSize/Shards ratio as
+// DefaultInMemoryCacheConfig, where an evenly-divided per-shard share
+// (250MB/16 ≈ 15.6MB) would otherwise be smaller than MaxItemSize (125MB).
+func TestInMemoryCache_MaxItemSizeNotDividedByShards(t *testing.T) {
+	c, err := NewInMemoryCacheWithConfig("test", log.NewNopLogger(), nil, InMemoryCacheConfig{
+		MaxSize:     DefaultInMemoryCacheConfig.MaxSize,
+		MaxItemSize: DefaultInMemoryCacheConfig.MaxItemSize,
+		Shards:      DefaultInMemoryCacheConfig.Shards,
+	})
+	if err != nil {
+		t.Fatalf("NewInMemoryCacheWithConfig: %v", err)
+	}
+	defer c.Close()
+
+	maxItemSize := int(DefaultInMemoryCacheConfig.MaxItemSize)
+	val := make([]byte, maxItemSize)
+	c.Store(map[string][]byte{"big": val}, time.Hour)
+
+	got := c.Fetch(context.Background(), []string{"big"})
+	if len(got["big"]) != maxItemSize {
+		t.Fatalf("expected an item of exactly MaxItemSize to be stored, got %d bytes back", len(got["big"]))
+	}
+}
+
+// TestInMemoryCache_FetchBatchesByShard verifies that Fetch returns every
+// stored key irrespective of which shard it lands on.
+func TestInMemoryCache_FetchBatchesByShard(t *testing.T) {
+	c, err := NewInMemoryCacheWithConfig("test", log.NewNopLogger(), nil, InMemoryCacheConfig{
+		MaxSize:     1 << 20,
+		MaxItemSize: 1 << 20,
+		Shards:      16,
+	})
+	if err != nil {
+		t.Fatalf("NewInMemoryCacheWithConfig: %v", err)
+	}
+	defer c.Close()
+
+	data := make(map[string][]byte, 64)
+	keys := make([]string, 0, 64)
+	for i := 0; i < 64; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		data[key] = []byte(fmt.Sprintf("val-%d", i))
+		keys = append(keys, key)
+	}
+	c.Store(data, time.Hour)
+
+	got := c.Fetch(context.Background(), keys)
+	if len(got) != len(data) {
+		t.Fatalf("expected %d hits, got %d", len(data), len(got))
+	}
+	for k, v := range data {
+		if string(got[k]) != string(v) {
+			t.Fatalf("key %q: expected %q, got %q", k, v, got[k])
+		}
+	}
+}
+
+// TestInMemoryCache_ConcurrentFetchStore exercises concurrent Store/Fetch
+// calls across shards under the race detector.
+func TestInMemoryCache_ConcurrentFetchStore(t *testing.T) {
+	c, err := NewInMemoryCacheWithConfig("test", log.NewNopLogger(), nil, InMemoryCacheConfig{
+		MaxSize:     1 << 20,
+		MaxItemSize: 1 << 20,
+		Shards:      16,
+	})
+	if err != nil {
+		t.Fatalf("NewInMemoryCacheWithConfig: %v", err)
+	}
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	for g := 0; g < 32; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				key := fmt.Sprintf("g%d-k%d", g, i)
+				c.Store(map[string][]byte{key: []byte("v")}, time.Hour)
+				c.Fetch(context.Background(), []string{key})
+			}
+		}(g)
+	}
+	wg.Wait()
+}
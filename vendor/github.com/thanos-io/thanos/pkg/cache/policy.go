@@ -0,0 +1,39 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package cache
+
+// evictionStore abstracts the storage layer used within a shard to hold
+// cacheDataWithTTLWrapper entries, so InMemoryCache can plug in an eviction
+// policy other than plain LRU. It mirrors *lru.LRU's own method set, which is
+// why *lru.LRU[string, cacheDataWithTTLWrapper] satisfies it without any glue.
+type evictionStore interface {
+	Add(key string, value cacheDataWithTTLWrapper) (evicted bool)
+	Get(key string) (cacheDataWithTTLWrapper, bool)
+	Peek(key string) (cacheDataWithTTLWrapper, bool)
+	Remove(key string) bool
+	RemoveOldest() (string, cacheDataWithTTLWrapper, bool)
+	Keys() []string
+	Len() int
+	Purge()
+}
+
+const (
+	evictionPolicyLRU     = "lru"
+	evictionPolicyS3FIFO  = "s3fifo"
+	defaultEvictionPolicy = evictionPolicyLRU
+)
+
+// S3FIFOConfig tunes the S3-FIFO eviction policy. It is ignored unless
+// InMemoryCacheConfig.EvictionPolicy is "s3fifo". Zero values fall back to
+// newS3FIFOStore's own defaults (a 10% small-queue ratio, a 10000-entry ghost
+// queue), so operators only need to set what they want to override.
+type S3FIFOConfig struct {
+	// SmallQueueRatio is the fraction of a shard's size budget given to the S
+	// (small, FIFO admission) queue; the rest goes to the M (main) queue. Must
+	// be in (0, 1).
+	SmallQueueRatio float64 `yaml:"small_queue_ratio"`
+	// GhostCapacity is the maximum number of recently-evicted-from-S keys
+	// tracked for direct re-promotion into M.
+	GhostCapacity int `yaml:"ghost_capacity"`
+}
@@ -0,0 +1,299 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package cache
+
+import (
+	"container/list"
+	"sync"
+)
+
+// s3fifoStore implements evictionStore using S3-FIFO (Yang et al., FAST'23),
+// which is more scan-resistant than plain LRU: a single large one-shot scan
+// only ever flows through the small S queue and can't wipe long-resident hot
+// entries sitting in M.
+//
+//   - S (small, ~10% of the size budget): FIFO admission queue for new keys.
+//   - M (main, the rest of the budget): FIFO queue for keys promoted out of S.
+//   - G (ghost): keys-only record of items recently evicted from S. Re-inserting
+//     a ghosted key promotes it straight into M instead of back into S.
+//
+// Every entry also carries a "hit bit", set on each Get, used both to decide
+// S -> M promotion and for the second-chance sweep when evicting from M.
+type s3fifoStore struct {
+	mtx sync.Mutex
+
+	onEvict func(key string, val cacheDataWithTTLWrapper)
+
+	sBudget  uint64
+	mBudget  uint64
+	ghostCap int
+
+	sSize uint64
+	mSize uint64
+
+	s          *list.List // of *s3fifoEntry, oldest at Front
+	m          *list.List // of *s3fifoEntry, oldest at Front
+	ghost      *list.List // of string, oldest at Front
+	index      map[string]*list.Element
+	ghostIndex map[string]*list.Element
+}
+
+type s3fifoEntry struct {
+	key  string
+	val  cacheDataWithTTLWrapper
+	size uint64
+	hit  bool
+	// inMain records which queue the entry currently lives in, so callers don't
+	// have to walk s.m to find out.
+	inMain bool
+}
+
+// newS3FIFOStore creates an S3-FIFO store with the S queue sized at sRatio of
+// totalBudget (an sRatio outside (0, 1) is replaced by 0.1) and a ghost queue
+// tracking up to ghostCap recently-evicted-from-S keys (10000 if ghostCap <= 0).
+func newS3FIFOStore(totalBudget uint64, sRatio float64, ghostCap int, onEvict func(key string, val cacheDataWithTTLWrapper)) *s3fifoStore {
+	if sRatio <= 0 || sRatio >= 1 {
+		sRatio = 0.1
+	}
+	if ghostCap <= 0 {
+		ghostCap = 10000
+	}
+	sBudget := uint64(float64(totalBudget) * sRatio)
+	return &s3fifoStore{
+		onEvict:    onEvict,
+		sBudget:    sBudget,
+		mBudget:    totalBudget - sBudget,
+		ghostCap:   ghostCap,
+		s:          list.New(),
+		m:          list.New(),
+		ghost:      list.New(),
+		index:      make(map[string]*list.Element),
+		ghostIndex: make(map[string]*list.Element),
+	}
+}
+
+func (s *s3fifoStore) Add(key string, value cacheDataWithTTLWrapper) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if el, ok := s.index[key]; ok {
+		e := el.Value.(*s3fifoEntry)
+		s.adjustSize(e, value)
+		e.val = value
+		return false
+	}
+
+	size := uint64(len(value.data))
+	e := &s3fifoEntry{key: key, val: value, size: size}
+
+	if gel, ok := s.ghostIndex[key]; ok {
+		s.ghost.Remove(gel)
+		delete(s.ghostIndex, key)
+		e.inMain = true
+		s.index[key] = s.m.PushBack(e)
+		s.mSize += size
+		return false
+	}
+
+	s.index[key] = s.s.PushBack(e)
+	s.sSize += size
+	return false
+}
+
+// adjustSize updates per-queue accounting when Add overwrites an existing key
+// with a differently-sized value. Must be called with s.mtx held.
+func (s *s3fifoStore) adjustSize(e *s3fifoEntry, newVal cacheDataWithTTLWrapper) {
+	newSize := uint64(len(newVal.data))
+	if e.size == newSize {
+		return
+	}
+	if e.inMain {
+		s.mSize = s.mSize - e.size + newSize
+	} else {
+		s.sSize = s.sSize - e.size + newSize
+	}
+	e.size = newSize
+}
+
+func (s *s3fifoStore) Get(key string) (cacheDataWithTTLWrapper, bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	el, ok := s.index[key]
+	if !ok {
+		return cacheDataWithTTLWrapper{}, false
+	}
+	e := el.Value.(*s3fifoEntry)
+	e.hit = true
+	return e.val, true
+}
+
+func (s *s3fifoStore) Peek(key string) (cacheDataWithTTLWrapper, bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	el, ok := s.index[key]
+	if !ok {
+		return cacheDataWithTTLWrapper{}, false
+	}
+	return el.Value.(*s3fifoEntry).val, true
+}
+
+func (s *s3fifoStore) Remove(key string) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if gel, ok := s.ghostIndex[key]; ok {
+		s.ghost.Remove(gel)
+		delete(s.ghostIndex, key)
+	}
+
+	el, ok := s.index[key]
+	if !ok {
+		return false
+	}
+	e := el.Value.(*s3fifoEntry)
+	if e.inMain {
+		s.m.Remove(el)
+		s.mSize -= e.size
+	} else {
+		s.s.Remove(el)
+		s.sSize -= e.size
+	}
+	delete(s.index, key)
+	if s.onEvict != nil {
+		s.onEvict(e.key, e.val)
+	}
+	return true
+}
+
+// RemoveOldest runs the S3-FIFO eviction algorithm: it evicts from S when S has
+// reached its budget (or M is empty), otherwise from M, performing any number of
+// internal promotions/second-chance requeues along the way before it settles
+// on an entry to actually evict.
+func (s *s3fifoStore) RemoveOldest() (string, cacheDataWithTTLWrapper, bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	for {
+		if s.sSize > 0 && (s.sSize >= s.sBudget || s.mSize == 0) {
+			if key, val, ok := s.evictFromS(); ok {
+				return key, val, true
+			}
+			continue
+		}
+		if s.mSize > 0 {
+			if key, val, ok := s.evictFromM(); ok {
+				return key, val, true
+			}
+			continue
+		}
+		return "", cacheDataWithTTLWrapper{}, false
+	}
+}
+
+// evictFromS pops the head of S. A hit item is promoted to the back of M
+// (ok=false, caller should retry); a cold item is evicted for real and
+// recorded in the ghost queue. Must be called with s.mtx held.
+func (s *s3fifoStore) evictFromS() (string, cacheDataWithTTLWrapper, bool) {
+	front := s.s.Front()
+	if front == nil {
+		return "", cacheDataWithTTLWrapper{}, false
+	}
+	e := front.Value.(*s3fifoEntry)
+	s.s.Remove(front)
+	s.sSize -= e.size
+
+	if e.hit {
+		e.hit = false
+		e.inMain = true
+		s.index[e.key] = s.m.PushBack(e)
+		s.mSize += e.size
+		return "", cacheDataWithTTLWrapper{}, false
+	}
+
+	delete(s.index, e.key)
+	s.addGhost(e.key)
+	if s.onEvict != nil {
+		s.onEvict(e.key, e.val)
+	}
+	return e.key, e.val, true
+}
+
+// evictFromM pops the head of M. A hit item gets its bit cleared and is moved
+// to the back (second chance, ok=false); a cold item is evicted for real.
+// Must be called with s.mtx held.
+func (s *s3fifoStore) evictFromM() (string, cacheDataWithTTLWrapper, bool) {
+	front := s.m.Front()
+	if front == nil {
+		return "", cacheDataWithTTLWrapper{}, false
+	}
+	e := front.Value.(*s3fifoEntry)
+	if e.hit {
+		e.hit = false
+		s.m.MoveToBack(front)
+		return "", cacheDataWithTTLWrapper{}, false
+	}
+
+	s.m.Remove(front)
+	s.mSize -= e.size
+	delete(s.index, e.key)
+	if s.onEvict != nil {
+		s.onEvict(e.key, e.val)
+	}
+	return e.key, e.val, true
+}
+
+func (s *s3fifoStore) addGhost(key string) {
+	s.ghostIndex[key] = s.ghost.PushBack(key)
+	for len(s.ghostIndex) > s.ghostCap {
+		front := s.ghost.Front()
+		if front == nil {
+			break
+		}
+		s.ghost.Remove(front)
+		delete(s.ghostIndex, front.Value.(string))
+	}
+}
+
+func (s *s3fifoStore) Keys() []string {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	keys := make([]string, 0, len(s.index))
+	for cur := s.s.Front(); cur != nil; cur = cur.Next() {
+		keys = append(keys, cur.Value.(*s3fifoEntry).key)
+	}
+	for cur := s.m.Front(); cur != nil; cur = cur.Next() {
+		keys = append(keys, cur.Value.(*s3fifoEntry).key)
+	}
+	return keys
+}
+
+func (s *s3fifoStore) Len() int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return len(s.index)
+}
+
+func (s *s3fifoStore) Purge() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.s.Init()
+	s.m.Init()
+	s.ghost.Init()
+	s.index = make(map[string]*list.Element)
+	s.ghostIndex = make(map[string]*list.Element)
+	s.sSize = 0
+	s.mSize = 0
+}
+
+// queueSizes reports the current byte size of the S and M queues, for the
+// per-queue size gauges exposed by InMemoryCache.
+func (s *s3fifoStore) queueSizes() (sSize, mSize uint64) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.sSize, s.mSize
+}
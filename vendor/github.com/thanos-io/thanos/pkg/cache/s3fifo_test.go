@@ -0,0 +1,116 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package cache
+
+import "testing"
+
+func s3Val(s string) cacheDataWithTTLWrapper {
+	return cacheDataWithTTLWrapper{data: []byte(s)}
+}
+
+// TestS3FIFOStore_ColdEntryEvictedFromS verifies that an entry which is never
+// Get (no hit bit set) is evicted for real once it reaches the head of S,
+// rather than promoted to M.
+func TestS3FIFOStore_ColdEntryEvictedFromS(t *testing.T) {
+	var evicted []string
+	s := newS3FIFOStore(100, 0.5, 10, func(key string, _ cacheDataWithTTLWrapper) {
+		evicted = append(evicted, key)
+	})
+
+	s.Add("a", s3Val("1"))
+	s.Add("b", s3Val("2"))
+
+	// "a" is never Get, so it has no hit bit; it should be evicted outright
+	// when it reaches the front of S, not promoted to M.
+	key, _, ok := s.RemoveOldest()
+	if !ok || key != "a" {
+		t.Fatalf("expected cold entry \"a\" to be evicted first, got key=%q ok=%v", key, ok)
+	}
+	if len(evicted) != 1 || evicted[0] != "a" {
+		t.Fatalf("onEvict callback not invoked for the evicted key, got %v", evicted)
+	}
+}
+
+// TestS3FIFOStore_HitEntryPromotedFromSToM verifies that an entry Get at
+// least once before it is evicted from S is promoted into M instead of being
+// evicted for real.
+func TestS3FIFOStore_HitEntryPromotedFromSToM(t *testing.T) {
+	s := newS3FIFOStore(100, 0.5, 10, nil)
+
+	s.Add("a", s3Val("1"))
+	if _, ok := s.Get("a"); !ok {
+		t.Fatalf("expected Get(\"a\") to hit")
+	}
+
+	key, _, ok := s.evictFromS()
+	if ok {
+		t.Fatalf("expected hit entry \"a\" to be promoted rather than evicted, got key=%q", key)
+	}
+	el, ok := s.index["a"]
+	if !ok {
+		t.Fatalf("expected \"a\" to still be tracked after promotion")
+	}
+	if !el.Value.(*s3fifoEntry).inMain {
+		t.Fatalf("expected \"a\" to have been promoted into M")
+	}
+}
+
+// TestS3FIFOStore_GhostPromotesDirectlyToMain verifies that re-adding a key
+// shortly after it was evicted from S (while still in the ghost queue)
+// promotes it straight into M instead of back into S.
+func TestS3FIFOStore_GhostPromotesDirectlyToMain(t *testing.T) {
+	s := newS3FIFOStore(100, 0.5, 10, nil)
+
+	s.Add("a", s3Val("1"))
+	key, _, ok := s.evictFromS()
+	if !ok || key != "a" {
+		t.Fatalf("setup: expected \"a\" to be evicted from S, got key=%q ok=%v", key, ok)
+	}
+	if _, ok := s.ghostIndex["a"]; !ok {
+		t.Fatalf("setup: expected \"a\" to be recorded in the ghost queue")
+	}
+
+	s.Add("a", s3Val("2"))
+	el, ok := s.index["a"]
+	if !ok {
+		t.Fatalf("expected \"a\" to be re-admitted")
+	}
+	if !el.Value.(*s3fifoEntry).inMain {
+		t.Fatalf("expected ghost re-admission of \"a\" to land directly in M, not S")
+	}
+	if _, ok := s.ghostIndex["a"]; ok {
+		t.Fatalf("expected \"a\" to be removed from the ghost queue on re-admission")
+	}
+}
+
+// TestS3FIFOStore_SecondChanceSweepInM verifies that a hit entry at the head
+// of M gets its bit cleared and is moved to the back instead of being
+// evicted, and that the cold entry behind it is evicted instead.
+func TestS3FIFOStore_SecondChanceSweepInM(t *testing.T) {
+	s := newS3FIFOStore(100, 0.5, 10, nil)
+
+	// Ghost-promote both keys straight into M, in order a, b.
+	s.Add("a", s3Val("1"))
+	s.evictFromS()
+	s.Add("a", s3Val("1"))
+
+	s.Add("b", s3Val("2"))
+	s.evictFromS()
+	s.Add("b", s3Val("2"))
+
+	if _, ok := s.Get("a"); !ok {
+		t.Fatalf("expected Get(\"a\") to hit")
+	}
+
+	// "a" is at the head of M with its hit bit set: it should get a second
+	// chance (moved to back, bit cleared) rather than be evicted; "b" is cold
+	// and should be evicted instead.
+	key, _, ok := s.RemoveOldest()
+	if !ok || key != "b" {
+		t.Fatalf("expected \"b\" to be evicted from M after \"a\" got a second chance, got key=%q ok=%v", key, ok)
+	}
+	if _, ok := s.index["a"]; !ok {
+		t.Fatalf("expected \"a\" to survive the second-chance sweep")
+	}
+}
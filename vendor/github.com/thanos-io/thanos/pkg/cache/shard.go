@@ -0,0 +1,353 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package cache
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	lru "github.com/hashicorp/golang-lru/v2/simplelru"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// shardMetrics are the counters shared by all shards of an InMemoryCache. They are
+// safe for concurrent use, so every shard can increment them directly rather than
+// each shard keeping (and the cache having to aggregate) its own copy.
+type shardMetrics struct {
+	evicted        prometheus.Counter
+	requests       prometheus.Counter
+	hits           prometheus.Counter
+	hitsExpired    prometheus.Counter
+	ttlExpirations prometheus.Counter
+	added          prometheus.Counter
+	overflow       prometheus.Counter
+	deletions      *prometheus.CounterVec
+
+	// onItemEvicted, if set, is invoked whenever an entry is evicted from any shard.
+	// It is used by TieredCache to spill still-fresh entries down to its L2 instead
+	// of letting them be dropped on the floor.
+	onItemEvicted func(key string, val cacheDataWithTTLWrapper)
+}
+
+// inMemoryShard is one of the N independent partitions an InMemoryCache is split
+// into so that concurrent Get/Set calls hitting different keys don't serialize on
+// a single mutex. Its gauges (item count, byte size) are read lazily by the parent
+// cache's GaugeFunc collectors rather than pushed eagerly, so scraping them just
+// means taking each shard's mutex once.
+type inMemoryShard struct {
+	logger           log.Logger
+	maxSizeBytes     uint64
+	maxItemSizeBytes uint64
+	metrics          *shardMetrics
+
+	mtx       sync.Mutex
+	curSize   uint64
+	totalSize uint64
+	itemCount int
+
+	// suppressEvictHook, while true, tells onEvict to skip invoking
+	// metrics.onItemEvicted. Set around removeLocked calls made on behalf of
+	// delete/deleteByPrefix, which are explicit application-level removals, not
+	// capacity evictions — for TieredCache, firing the hook here would spill a
+	// still-fresh, explicitly-deleted entry right back down to L2.
+	suppressEvictHook bool
+
+	// store backs the shard in the default mode, where each entry carries its own
+	// TTL and expiration is checked lazily on Get. Its eviction policy is chosen by
+	// InMemoryCacheConfig.EvictionPolicy. It is nil when expirableLRU is in use.
+	store evictionStore
+	// expirableLRU backs the shard when InMemoryCacheConfig.TTL is set: every entry
+	// shares one TTL, so the library can expire entries itself. EvictionPolicy does
+	// not apply in this mode.
+	expirableLRU *expirableLRU
+}
+
+func newInMemoryShard(logger log.Logger, maxSizeBytes, maxItemSizeBytes uint64, ttl time.Duration, policy string, s3fifo S3FIFOConfig, metrics *shardMetrics) (*inMemoryShard, error) {
+	s := &inMemoryShard{
+		logger:           logger,
+		maxSizeBytes:     maxSizeBytes,
+		maxItemSizeBytes: maxItemSizeBytes,
+		metrics:          metrics,
+	}
+
+	if ttl > 0 {
+		s.expirableLRU = newExpirableLRU(ttl, s.onEvict)
+		return s, nil
+	}
+
+	switch policy {
+	case evictionPolicyS3FIFO:
+		s.store = newS3FIFOStore(maxSizeBytes, s3fifo.SmallQueueRatio, s3fifo.GhostCapacity, s.onEvict)
+	default:
+		l, err := lru.NewLRU[string, cacheDataWithTTLWrapper](maxInt, s.onEvict)
+		if err != nil {
+			return nil, err
+		}
+		s.store = l
+	}
+	return s, nil
+}
+
+func (s *inMemoryShard) onEvict(key string, val cacheDataWithTTLWrapper) {
+	keySize := uint64(len(key))
+	entrySize := uint64(len(val.data))
+
+	s.metrics.evicted.Inc()
+	s.curSize -= entrySize
+	s.totalSize -= keySize + entrySize
+	s.itemCount--
+
+	if s.metrics.onItemEvicted != nil && !s.suppressEvictHook {
+		s.metrics.onItemEvicted(key, val)
+	}
+}
+
+func (s *inMemoryShard) get(key string) ([]byte, bool) {
+	s.metrics.requests.Inc()
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.getLocked(key)
+}
+
+// getMulti fetches keys in one critical section and writes hits into dst,
+// instead of taking s.mtx once per key.
+func (s *inMemoryShard) getMulti(keys []string, dst map[string][]byte) {
+	s.metrics.requests.Add(float64(len(keys)))
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	for _, key := range keys {
+		if b, ok := s.getLocked(key); ok {
+			dst[key] = b
+		}
+	}
+}
+
+// getLocked is the shared implementation of get/getMulti. Must be called with
+// s.mtx held; it does not increment s.metrics.requests itself, since callers
+// account for that differently depending on whether they're fetching one key
+// or a batch.
+func (s *inMemoryShard) getLocked(key string) ([]byte, bool) {
+	if s.expirableLRU != nil {
+		v, ok := s.expirableLRU.Get(key)
+		if !ok {
+			return nil, false
+		}
+		s.metrics.hits.Inc()
+		return v, true
+	}
+
+	v, ok := s.store.Get(key)
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(v.expiryTime) {
+		s.metrics.hitsExpired.Inc()
+		s.removeLocked(key)
+		return nil, false
+	}
+	s.metrics.hits.Inc()
+	return v.data, true
+}
+
+func (s *inMemoryShard) set(key string, val []byte, ttl time.Duration) {
+	size := uint64(len(val))
+	keySize := uint64(len(key))
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.expirableLRU != nil {
+		if s.expirableLRU.Contains(key) {
+			return
+		}
+		if !s.ensureFits(size) {
+			s.metrics.overflow.Inc()
+			return
+		}
+
+		v := make([]byte, len(val))
+		copy(v, val)
+		s.expirableLRU.Add(key, v)
+	} else {
+		if _, ok := s.store.Get(key); ok {
+			return
+		}
+		if !s.ensureFits(size) {
+			s.metrics.overflow.Inc()
+			return
+		}
+
+		// The caller may be passing in a sub-slice of a huge array. Copy the data
+		// to ensure we don't waste huge amounts of space for something small.
+		v := make([]byte, len(val))
+		copy(v, val)
+		s.store.Add(key, cacheDataWithTTLWrapper{data: v, expiryTime: time.Now().Add(ttl)})
+	}
+
+	s.metrics.added.Inc()
+	s.curSize += size
+	s.totalSize += keySize + size
+	s.itemCount++
+}
+
+// ensureFits tries to make sure that the passed slice will fit into the shard.
+// Returns true if it will fit. Must be called with s.mtx held.
+func (s *inMemoryShard) ensureFits(size uint64) bool {
+	// maxItemSizeBytes is a whole-cache budget, not divided per shard (a single
+	// item is never split across shards), so it alone no longer guarantees
+	// size <= s.maxSizeBytes the way it did before shards had their own,
+	// smaller share of MaxSize. Without this check, an item larger than this
+	// shard's share of MaxSize but within maxItemSizeBytes would make the loop
+	// below spin forever: even an emptied shard could never fit it.
+	if size > s.maxItemSizeBytes || size > s.maxSizeBytes {
+		level.Debug(s.logger).Log(
+			"msg", "item bigger than maxItemSizeBytes or this shard's share of maxSizeBytes. Ignoring..",
+			"maxItemSizeBytes", s.maxItemSizeBytes,
+			"maxSizeBytes", s.maxSizeBytes,
+			"curSize", s.curSize,
+			"itemSize", size,
+		)
+		return false
+	}
+
+	for s.curSize+size > s.maxSizeBytes {
+		if !s.removeOldest() {
+			level.Error(s.logger).Log(
+				"msg", "shard has nothing more to evict, but we still cannot allocate the item. Resetting shard.",
+				"maxItemSizeBytes", s.maxItemSizeBytes,
+				"maxSizeBytes", s.maxSizeBytes,
+				"curSize", s.curSize,
+				"itemSize", size,
+			)
+			s.reset()
+		}
+	}
+	return true
+}
+
+// removeOldest evicts one entry chosen by the active eviction policy. Must be
+// called with s.mtx held.
+func (s *inMemoryShard) removeOldest() bool {
+	if s.expirableLRU != nil {
+		_, _, ok := s.expirableLRU.RemoveOldest()
+		return ok
+	}
+	_, _, ok := s.store.RemoveOldest()
+	return ok
+}
+
+// removeLocked removes key from whichever store backs the shard and fires
+// onEvict. Must be called with s.mtx held.
+func (s *inMemoryShard) removeLocked(key string) bool {
+	if s.expirableLRU != nil {
+		return s.expirableLRU.Remove(key)
+	}
+	return s.store.Remove(key)
+}
+
+// removeLockedNoEvictHook behaves like removeLocked but suppresses
+// metrics.onItemEvicted for the duration of the call, so an explicit delete
+// isn't reported to (and, for TieredCache, spilled to L2 by) the capacity-
+// eviction hook. Must be called with s.mtx held.
+func (s *inMemoryShard) removeLockedNoEvictHook(key string) bool {
+	s.suppressEvictHook = true
+	defer func() { s.suppressEvictHook = false }()
+	return s.removeLocked(key)
+}
+
+// keysLocked returns the keys held by whichever store backs the shard. Must be
+// called with s.mtx held.
+func (s *inMemoryShard) keysLocked() []string {
+	if s.expirableLRU != nil {
+		return s.expirableLRU.Keys()
+	}
+	return s.store.Keys()
+}
+
+// delete removes key, if present, and reports whether it was. Unlike an
+// eviction, this doesn't fire metrics.onItemEvicted: an explicit delete is not
+// a capacity eviction, and TieredCache relies on that hook only to spill
+// still-fresh evictions down to L2.
+func (s *inMemoryShard) delete(key string) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.removeLockedNoEvictHook(key)
+}
+
+// deleteByPrefix removes every key with the given prefix and returns how many
+// were removed. Like delete, it doesn't fire metrics.onItemEvicted.
+func (s *inMemoryShard) deleteByPrefix(prefix string) int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	n := 0
+	for _, key := range s.keysLocked() {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if s.removeLockedNoEvictHook(key) {
+			n++
+		}
+	}
+	return n
+}
+
+// reset purges the shard. Must be called with s.mtx held.
+func (s *inMemoryShard) reset() {
+	if s.expirableLRU != nil {
+		s.expirableLRU.Purge()
+	} else {
+		s.store.Purge()
+	}
+	s.curSize = 0
+	s.totalSize = 0
+	s.itemCount = 0
+}
+
+// sweepExpired removes entries whose TTL has passed. It is a no-op in expirable
+// mode, where the underlying store expires entries on its own.
+func (s *inMemoryShard) sweepExpired() {
+	if s.expirableLRU != nil {
+		return
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	now := time.Now()
+	for _, key := range s.store.Keys() {
+		v, ok := s.store.Peek(key)
+		if !ok || !now.After(v.expiryTime) {
+			continue
+		}
+		s.metrics.ttlExpirations.Inc()
+		// Remove triggers onEvict, which keeps curSize/totalSize/itemCount in sync.
+		s.removeLocked(key)
+	}
+}
+
+func (s *inMemoryShard) stats() (itemCount int, curSize, totalSize uint64) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.itemCount, s.curSize, s.totalSize
+}
+
+// s3fifoQueueSizes reports the byte size of the S and M queues when the shard is
+// running the s3fifo eviction policy, and (0, 0, false) otherwise.
+func (s *inMemoryShard) s3fifoQueueSizes() (sSize, mSize uint64, ok bool) {
+	s.mtx.Lock()
+	store := s.store
+	s.mtx.Unlock()
+
+	s3, ok := store.(*s3fifoStore)
+	if !ok {
+		return 0, 0, false
+	}
+	sSize, mSize = s3.queueSizes()
+	return sSize, mSize, true
+}
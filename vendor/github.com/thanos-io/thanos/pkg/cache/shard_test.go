@@ -0,0 +1,73 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package cache
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+
+	"github.com/thanos-io/thanos/pkg/model"
+)
+
+// TestInMemoryCache_TTLJanitor verifies that the background cleanup janitor
+// removes entries once their per-item TTL has passed, without needing a Fetch
+// to touch them first.
+func TestInMemoryCache_TTLJanitor(t *testing.T) {
+	c, err := NewInMemoryCacheWithConfig("test", log.NewNopLogger(), nil, InMemoryCacheConfig{
+		MaxSize:         1024,
+		MaxItemSize:     1024,
+		Shards:          1,
+		CleanupInterval: model.Duration(10 * time.Millisecond),
+	})
+	if err != nil {
+		t.Fatalf("NewInMemoryCacheWithConfig: %v", err)
+	}
+	defer c.Close()
+
+	c.Store(map[string][]byte{"foo": []byte("bar")}, 20*time.Millisecond)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		n, _, _ := c.aggregateStats()
+		if n == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("expired entry was not swept by the TTL janitor")
+}
+
+// TestInMemoryCache_ExpirableLRU verifies that when InMemoryCacheConfig.TTL is
+// set, entries expire on their own even though the ttl argument passed to
+// Store is ignored.
+func TestInMemoryCache_ExpirableLRU(t *testing.T) {
+	c, err := NewInMemoryCacheWithConfig("test", log.NewNopLogger(), nil, InMemoryCacheConfig{
+		MaxSize:     1024,
+		MaxItemSize: 1024,
+		Shards:      1,
+		TTL:         model.Duration(20 * time.Millisecond),
+	})
+	if err != nil {
+		t.Fatalf("NewInMemoryCacheWithConfig: %v", err)
+	}
+	defer c.Close()
+
+	// The ttl argument below should be ignored in favor of the shared config.TTL.
+	c.Store(map[string][]byte{"foo": []byte("bar")}, time.Hour)
+
+	res := c.Fetch(context.Background(), []string{"foo"})
+	if string(res["foo"]) != "bar" {
+		t.Fatalf("expected immediate hit, got %v", res)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	res = c.Fetch(context.Background(), []string{"foo"})
+	if _, ok := res["foo"]; ok {
+		t.Fatalf("expected entry to have expired via the shared TTL, got %v", res)
+	}
+}
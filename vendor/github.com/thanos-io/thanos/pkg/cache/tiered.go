@@ -0,0 +1,226 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package cache
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"gopkg.in/yaml.v2"
+
+	"github.com/thanos-io/thanos/pkg/model"
+)
+
+// TieredCacheConfig configures a TieredCache: an in-memory L1 backed by a
+// disk-persisted L2.
+type TieredCacheConfig struct {
+	L1 InMemoryCacheConfig `yaml:"l1"`
+	L2 DiskCacheConfig     `yaml:"l2"`
+	// L2HydrateTTL is the TTL applied to entries pulled back into L1 after an L2 hit.
+	// Fetch() has no ttl argument of its own, so this stands in for it. Required:
+	// NewTieredCacheWithConfig rejects a zero value rather than silently hydrating
+	// entries that expire in L1 immediately.
+	L2HydrateTTL model.Duration `yaml:"l2_hydrate_ttl"`
+}
+
+// TieredCache composes an in-memory L1 with a disk-backed L2, so that caching
+// bucket deployments can retain warm blocks across process restarts and handle
+// working sets bigger than RAM allows. On an L1 miss it falls back to L2 and
+// hydrates L1 on a hit; entries evicted live from L1 are handed to L2 instead of
+// being dropped.
+type TieredCache struct {
+	name string
+	l1   *InMemoryCache
+	l2   *diskCache
+
+	l2HydrateTTL time.Duration
+
+	l1Hits, l1Misses prometheus.Counter
+	l2Hits, l2Misses prometheus.Counter
+	l1Promotions     prometheus.Counter // L2 hit hydrated back into L1.
+	l2Promotions     prometheus.Counter // Still-fresh L1 eviction spilled to L2.
+}
+
+// parseTieredCacheConfig unmarshals a buffer into a TieredCacheConfig.
+func parseTieredCacheConfig(conf []byte) (TieredCacheConfig, error) {
+	var config TieredCacheConfig
+	if err := yaml.Unmarshal(conf, &config); err != nil {
+		return TieredCacheConfig{}, err
+	}
+	return config, nil
+}
+
+// NewTieredCache creates a new TieredCache from YAML config.
+func NewTieredCache(name string, logger log.Logger, reg prometheus.Registerer, conf []byte) (*TieredCache, error) {
+	config, err := parseTieredCacheConfig(conf)
+	if err != nil {
+		return nil, err
+	}
+	return NewTieredCacheWithConfig(name, logger, reg, config)
+}
+
+// NewTieredCacheWithConfig creates a new TieredCache from a parsed config.
+func NewTieredCacheWithConfig(name string, logger log.Logger, reg prometheus.Registerer, config TieredCacheConfig) (*TieredCache, error) {
+	if config.L2.Dir == "" {
+		return nil, errors.New("tiered cache: l2.dir must be set")
+	}
+	if config.L2.MaxSize == 0 {
+		return nil, errors.New("tiered cache: l2.max_size must be set")
+	}
+	if config.L2.MaxItemSize == 0 {
+		return nil, errors.New("tiered cache: l2.max_item_size must be set")
+	}
+	if config.L2.MaxItemSize > config.L2.MaxSize {
+		return nil, errors.Errorf("tiered cache: l2.max_item_size (%v) cannot be bigger than l2.max_size (%v)", config.L2.MaxItemSize, config.L2.MaxSize)
+	}
+	if config.L2HydrateTTL <= 0 {
+		// A zero L2HydrateTTL would make Store() compute expiryTime as
+		// time.Now().Add(0), so entries hydrated from an L2 hit would already be
+		// (or immediately become) expired in L1, silently breaking promotion.
+		return nil, errors.New("tiered cache: l2_hydrate_ttl must be set to a positive duration")
+	}
+
+	l1, err := NewInMemoryCacheWithConfig(name, logger, reg, config.L1)
+	if err != nil {
+		return nil, errors.Wrap(err, "tiered cache: creating l1")
+	}
+
+	l2, err := newDiskCache(logger, config.L2)
+	if err != nil {
+		return nil, errors.Wrap(err, "tiered cache: creating l2")
+	}
+
+	t := &TieredCache{
+		name:         name,
+		l1:           l1,
+		l2:           l2,
+		l2HydrateTTL: time.Duration(config.L2HydrateTTL),
+	}
+
+	t.l1Hits = promauto.With(reg).NewCounter(prometheus.CounterOpts{
+		Name:        "thanos_cache_tiered_l1_hits_total",
+		Help:        "Total number of Fetch lookups served from the tiered cache's L1.",
+		ConstLabels: prometheus.Labels{"name": name},
+	})
+	t.l1Misses = promauto.With(reg).NewCounter(prometheus.CounterOpts{
+		Name:        "thanos_cache_tiered_l1_misses_total",
+		Help:        "Total number of Fetch lookups that missed the tiered cache's L1.",
+		ConstLabels: prometheus.Labels{"name": name},
+	})
+	t.l2Hits = promauto.With(reg).NewCounter(prometheus.CounterOpts{
+		Name:        "thanos_cache_tiered_l2_hits_total",
+		Help:        "Total number of Fetch lookups served from the tiered cache's L2.",
+		ConstLabels: prometheus.Labels{"name": name},
+	})
+	t.l2Misses = promauto.With(reg).NewCounter(prometheus.CounterOpts{
+		Name:        "thanos_cache_tiered_l2_misses_total",
+		Help:        "Total number of Fetch lookups that missed both L1 and L2.",
+		ConstLabels: prometheus.Labels{"name": name},
+	})
+	t.l1Promotions = promauto.With(reg).NewCounter(prometheus.CounterOpts{
+		Name:        "thanos_cache_tiered_l1_promotions_total",
+		Help:        "Total number of entries hydrated into L1 after an L2 hit.",
+		ConstLabels: prometheus.Labels{"name": name},
+	})
+	t.l2Promotions = promauto.With(reg).NewCounter(prometheus.CounterOpts{
+		Name:        "thanos_cache_tiered_l2_promotions_total",
+		Help:        "Total number of still-fresh entries handed from L1 to L2 on eviction.",
+		ConstLabels: prometheus.Labels{"name": name},
+	})
+
+	l1.setEvictionListener(t.onL1Evict)
+
+	return t, nil
+}
+
+// onL1Evict hands a still-fresh entry down to L2 instead of letting it be
+// dropped. It is invoked synchronously from within the owning L1 shard's
+// critical section, so the actual disk write is pushed onto a goroutine.
+func (t *TieredCache) onL1Evict(key string, val cacheDataWithTTLWrapper) {
+	if val.expiryTime.IsZero() || !val.expiryTime.After(time.Now()) {
+		// Either genuinely expired, or L1 is running in expirable-LRU mode, which
+		// doesn't track a per-entry expiry we can check here. Either way, don't
+		// spill it to disk.
+		return
+	}
+
+	data := val.data
+	go func() {
+		if t.l2.Set(key, data) {
+			t.l2Promotions.Inc()
+		}
+	}()
+}
+
+// Store writes data to L1. Entries L1 evicts while still fresh are handed to L2
+// asynchronously rather than dropped; see onL1Evict.
+func (t *TieredCache) Store(data map[string][]byte, ttl time.Duration) {
+	t.l1.Store(data, ttl)
+}
+
+// Fetch fetches multiple keys, checking L1 first and falling back to L2 on a
+// miss. L2 hits are hydrated back into L1.
+func (t *TieredCache) Fetch(ctx context.Context, keys []string) map[string][]byte {
+	results := t.l1.Fetch(ctx, keys)
+	for range results {
+		t.l1Hits.Inc()
+	}
+
+	if len(results) == len(keys) {
+		return results
+	}
+
+	for _, key := range keys {
+		if _, ok := results[key]; ok {
+			continue
+		}
+		t.l1Misses.Inc()
+
+		v, ok := t.l2.Get(key)
+		if !ok {
+			t.l2Misses.Inc()
+			continue
+		}
+		t.l2Hits.Inc()
+
+		results[key] = v
+		t.l1.Store(map[string][]byte{key: v}, t.l2HydrateTTL)
+		t.l1Promotions.Inc()
+	}
+
+	return results
+}
+
+// Delete removes key from both L1 and L2. It is a no-op if key isn't cached.
+func (t *TieredCache) Delete(ctx context.Context, key string) error {
+	if err := t.l1.Delete(ctx, key); err != nil {
+		return err
+	}
+	t.l2.Delete(key)
+	return nil
+}
+
+// DeleteByPrefix removes matching keys from L1 and returns how many were
+// removed. L2 only retains sha256 digests of keys, not the key strings
+// themselves, so prefix matching against it isn't possible; any L2 copy of a
+// deleted key is left for size-based eviction to clear later, since diskCache
+// has no TTL of its own. The doc comment on Cache.DeleteByPrefix allows for
+// this in implementations backed by more than one tier.
+func (t *TieredCache) DeleteByPrefix(ctx context.Context, prefix string) (int, error) {
+	return t.l1.DeleteByPrefix(ctx, prefix)
+}
+
+func (t *TieredCache) Name() string {
+	return t.name
+}
+
+// Close stops L1's background TTL janitor, if one was started. It is safe to
+// call on a TieredCache whose L1 never started one.
+func (t *TieredCache) Close() error {
+	return t.l1.Close()
+}
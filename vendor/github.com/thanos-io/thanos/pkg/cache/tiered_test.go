@@ -0,0 +1,160 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package cache
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/thanos-io/thanos/pkg/model"
+)
+
+func newTestTieredCache(t *testing.T, hydrateTTL time.Duration) *TieredCache {
+	t.Helper()
+	c, err := NewTieredCacheWithConfig("test", log.NewNopLogger(), nil, TieredCacheConfig{
+		L1: InMemoryCacheConfig{
+			MaxSize:     1 << 20,
+			MaxItemSize: 1 << 20,
+			Shards:      1,
+		},
+		L2: DiskCacheConfig{
+			Dir:         t.TempDir(),
+			MaxSize:     1 << 20,
+			MaxItemSize: 1 << 20,
+		},
+		L2HydrateTTL: model.Duration(hydrateTTL),
+	})
+	if err != nil {
+		t.Fatalf("NewTieredCacheWithConfig: %v", err)
+	}
+	return c
+}
+
+// TestNewTieredCacheWithConfig_RejectsZeroHydrateTTL verifies that a zero
+// L2HydrateTTL is rejected at construction instead of silently causing L2->L1
+// hydrated entries to expire immediately.
+func TestNewTieredCacheWithConfig_RejectsZeroHydrateTTL(t *testing.T) {
+	_, err := NewTieredCacheWithConfig("test", log.NewNopLogger(), nil, TieredCacheConfig{
+		L1: InMemoryCacheConfig{MaxSize: 1024, MaxItemSize: 1024, Shards: 1},
+		L2: DiskCacheConfig{Dir: t.TempDir(), MaxSize: 1024, MaxItemSize: 1024},
+	})
+	if err == nil {
+		t.Fatalf("expected an error for a zero L2HydrateTTL, got nil")
+	}
+}
+
+// TestTieredCache_HydratesL2HitIntoL1 verifies that a key present only in L2
+// is served on Fetch and promoted into L1, where it remains fetchable on its
+// own afterwards.
+func TestTieredCache_HydratesL2HitIntoL1(t *testing.T) {
+	c := newTestTieredCache(t, time.Hour)
+
+	if !c.l2.Set("foo", []byte("bar")) {
+		t.Fatalf("l2.Set failed")
+	}
+
+	res := c.Fetch(context.Background(), []string{"foo"})
+	if string(res["foo"]) != "bar" {
+		t.Fatalf("expected L2 hit to be returned, got %v", res)
+	}
+
+	// The entry should now be served straight out of L1.
+	l1Res := c.l1.Fetch(context.Background(), []string{"foo"})
+	if string(l1Res["foo"]) != "bar" {
+		t.Fatalf("expected L2 hit to have been hydrated into L1, got %v", l1Res)
+	}
+}
+
+// TestTieredCache_L1EvictionSpillsToL2 verifies that a still-fresh entry
+// evicted from L1 under capacity pressure is handed down to L2 asynchronously
+// (onL1Evict), rather than simply being dropped.
+func TestTieredCache_L1EvictionSpillsToL2(t *testing.T) {
+	c, err := NewTieredCacheWithConfig("test", log.NewNopLogger(), nil, TieredCacheConfig{
+		L1: InMemoryCacheConfig{
+			// Small enough that storing several items forces capacity eviction,
+			// but each item on its own still fits.
+			MaxSize:     25,
+			MaxItemSize: 20,
+			Shards:      1,
+		},
+		L2: DiskCacheConfig{
+			Dir:         t.TempDir(),
+			MaxSize:     1 << 20,
+			MaxItemSize: 1 << 20,
+		},
+		L2HydrateTTL: model.Duration(time.Hour),
+	})
+	if err != nil {
+		t.Fatalf("NewTieredCacheWithConfig: %v", err)
+	}
+
+	c.Store(map[string][]byte{"first": []byte("0123456789")}, time.Hour)
+	// "second" still fits (20 of 25 bytes); "third" pushes L1 over its MaxSize,
+	// evicting "first" (still fresh: TTL is an hour) as the oldest entry.
+	c.Store(map[string][]byte{"second": []byte("0123456789")}, time.Hour)
+	c.Store(map[string][]byte{"third": []byte("0123456789")}, time.Hour)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		// Check l2Promotions too, not just l2.Get: the spilling goroutine
+		// increments it right after the L2 write that makes the key visible,
+		// so an observation between those two steps must keep polling rather
+		// than fail outright.
+		if _, ok := c.l2.Get("first"); ok && testutil.ToFloat64(c.l2Promotions) == 1 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("expected the evicted, still-fresh \"first\" entry to be spilled into L2, with l2Promotions incremented")
+}
+
+// TestTieredCache_DeleteByPrefixOnlyClearsL1 documents the existing, weaker
+// DeleteByPrefix contract for TieredCache: L2 has no way to match by prefix,
+// so a deleted key can still be served from L2 until it's naturally evicted.
+func TestTieredCache_DeleteByPrefixOnlyClearsL1(t *testing.T) {
+	c := newTestTieredCache(t, time.Hour)
+
+	c.Store(map[string][]byte{"prefix-a": []byte("1")}, time.Hour)
+	if !c.l2.Set("prefix-a", []byte("1")) {
+		t.Fatalf("l2.Set failed")
+	}
+
+	n, err := c.DeleteByPrefix(context.Background(), "prefix-")
+	if err != nil {
+		t.Fatalf("DeleteByPrefix: %v", err)
+	}
+	if n != 1 {
+		t.Fatalf("expected 1 key removed from L1, got %d", n)
+	}
+
+	if _, ok := c.l1.Fetch(context.Background(), []string{"prefix-a"})["prefix-a"]; ok {
+		t.Fatalf("expected L1 copy to be gone")
+	}
+	if _, ok := c.l2.Get("prefix-a"); !ok {
+		t.Fatalf("expected L2 copy to still be present, per the documented limitation")
+	}
+}
+
+// TestTieredCache_DeleteDoesNotResurrectIntoL2 guards against a still-fresh L1
+// entry being spilled into L2 by the capacity-eviction hook as a side effect of
+// deleting it. Unlike TestTieredCache_DeleteByPrefixOnlyClearsL1, L2 starts
+// empty here, so a write performed by Delete (rather than a pre-existing copy)
+// is distinguishable: L2 must stay empty afterwards.
+func TestTieredCache_DeleteDoesNotResurrectIntoL2(t *testing.T) {
+	c := newTestTieredCache(t, time.Hour)
+
+	c.Store(map[string][]byte{"foo": []byte("bar")}, time.Hour)
+
+	if err := c.Delete(context.Background(), "foo"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+
+	if _, ok := c.l2.Get("foo"); ok {
+		t.Fatalf("expected Delete to not resurrect the deleted entry into L2")
+	}
+}